@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// backendMaxBodyBytes caps how much of a request body the HMAC is
+	// computed over, so a misbehaving (or hostile) caller can't tie up a
+	// handler hashing an unbounded payload.
+	backendMaxBodyBytes = 256 * 1024
+	// backendMinRandomBytes is the minimum length required of the
+	// Spreed-Signaling-Random nonce, per the Nextcloud Spreed backend
+	// protocol this follows.
+	backendMinRandomBytes = 32
+	// backendReplayWindow is how long a given nonce is remembered, so a
+	// captured request can't be replayed after this window passes.
+	backendReplayWindow = 5 * time.Minute
+)
+
+// backendSecrets maps a backend name (as sent in the Spreed-Signaling-Backend
+// header) to its shared HMAC secret, loaded from SIMS_BACKEND_SECRETS.
+var backendSecrets map[string]string
+
+// backendNonces remembers random nonces we've already seen, to reject
+// replayed requests within backendReplayWindow.
+var backendNonces = cache.New(backendReplayWindow, time.Minute)
+
+// loadBackendSecrets parses SIMS_BACKEND_SECRETS, formatted as
+// "name:secret,name2:secret2".
+func loadBackendSecrets() (map[string]string, error) {
+	raw := os.Getenv("SIMS_BACKEND_SECRETS")
+	secrets := make(map[string]string)
+	if raw == "" {
+		return secrets, nil
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		name, secret, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || secret == "" {
+			return nil, fmt.Errorf("invalid SIMS_BACKEND_SECRETS entry %q, want name:secret", entry)
+		}
+		secrets[name] = secret
+	}
+	return secrets, nil
+}
+
+// backendEnvelope is the JSON body external services send to drive sim
+// state without a browser session.
+type backendEnvelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// backendAuth verifies the Spreed-style HMAC headers on a backend request
+// and, on success, hands the raw body to next via the echo context under
+// backendBodyContextKey.
+func backendAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		random := c.Request().Header.Get("Spreed-Signaling-Random")
+		checksum := c.Request().Header.Get("Spreed-Signaling-Checksum")
+		backendName := c.Request().Header.Get("Spreed-Signaling-Backend")
+
+		if len(random) < backendMinRandomBytes {
+			return c.String(http.StatusUnauthorized, "Spreed-Signaling-Random missing or too short")
+		}
+		if checksum == "" || backendName == "" {
+			return c.String(http.StatusUnauthorized, "missing backend signature headers")
+		}
+
+		secret, ok := backendSecrets[backendName]
+		if !ok {
+			return c.String(http.StatusUnauthorized, "unknown backend")
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request().Body, backendMaxBodyBytes+1))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+		if len(body) > backendMaxBodyBytes {
+			return c.String(http.StatusRequestEntityTooLarge, "body too large")
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(random))
+		mac.Write(body)
+		expected := mac.Sum(nil)
+
+		got, err := hex.DecodeString(checksum)
+		if err != nil || !hmac.Equal(expected, got) {
+			return c.String(http.StatusUnauthorized, "checksum mismatch")
+		}
+
+		if _, seen := backendNonces.Get(random); seen {
+			return c.String(http.StatusUnauthorized, "replayed nonce")
+		}
+		backendNonces.Set(random, true, cache.DefaultExpiration)
+
+		c.Set(backendBodyContextKey, body)
+		return next(c)
+	}
+}
+
+// backendBodyContextKey is where backendAuth stashes the verified raw body
+// for handlers to parse, since the request body has already been drained.
+const backendBodyContextKey = "backendBody"
+
+// backendNeedsHandler lets an external service patch a room's needs the
+// same way the browser control POST does.
+func backendNeedsHandler(rooms *roomManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		roomID := c.Param("roomID")
+		envelope, err := parseBackendEnvelope(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if envelope.Type != "needs" {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("expected type \"needs\", got %q", envelope.Type))
+		}
+
+		patch := NeedsPatch{}
+		if err := json.Unmarshal(envelope.Data, &patch); err != nil {
+			return c.String(http.StatusBadRequest, "invalid needs payload")
+		}
+		rooms.patch(roomID, patch)
+		return c.String(http.StatusOK, "ok")
+	}
+}
+
+// backendEventHandler lets an external service publish an arbitrary event
+// onto the same sim.<roomID> subject the browser control path uses.
+func backendEventHandler(nc *nats.Conn) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		roomID := c.Param("roomID")
+		envelope, err := parseBackendEnvelope(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if envelope.Type != "event" {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("expected type \"event\", got %q", envelope.Type))
+		}
+
+		if err := nc.Publish("sim."+roomID, envelope.Data); err != nil {
+			return c.String(http.StatusInternalServerError, "failed to publish event")
+		}
+		return c.String(http.StatusOK, "ok")
+	}
+}
+
+func parseBackendEnvelope(c echo.Context) (backendEnvelope, error) {
+	body, _ := c.Get(backendBodyContextKey).([]byte)
+	envelope := backendEnvelope{}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return backendEnvelope{}, fmt.Errorf("invalid request envelope")
+	}
+	return envelope, nil
+}
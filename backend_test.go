@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// backendTestRequest builds a correctly-signed backend request for body,
+// using secret as the named backend's shared HMAC secret.
+func backendTestRequest(t *testing.T, backendName, secret, body string) *http.Request {
+	t.Helper()
+
+	random := make([]byte, backendMinRandomBytes)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	randomHex := hex.EncodeToString(random)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(randomHex))
+	mac.Write([]byte(body))
+	checksum := hex.EncodeToString(mac.Sum(nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Spreed-Signaling-Random", randomHex)
+	req.Header.Set("Spreed-Signaling-Checksum", checksum)
+	req.Header.Set("Spreed-Signaling-Backend", backendName)
+	return req
+}
+
+func TestBackendAuthAcceptsValidSignature(t *testing.T) {
+	backendSecrets = map[string]string{"room1": "shared-secret"}
+
+	e := echo.New()
+	req := backendTestRequest(t, "room1", "shared-secret", `{"type":"needs"}`)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	handler := backendAuth(func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	if err := handler(c); err != nil {
+		t.Fatalf("backendAuth returned error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestBackendAuthRejectsBadChecksum(t *testing.T) {
+	backendSecrets = map[string]string{"room1": "shared-secret"}
+
+	e := echo.New()
+	req := backendTestRequest(t, "room1", "wrong-secret", `{"type":"needs"}`)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	handler := backendAuth(func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	if err := handler(c); err != nil {
+		t.Fatalf("backendAuth returned error: %v", err)
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestBackendAuthRejectsUnknownBackend(t *testing.T) {
+	backendSecrets = map[string]string{"room1": "shared-secret"}
+
+	e := echo.New()
+	req := backendTestRequest(t, "room2", "shared-secret", `{"type":"needs"}`)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	handler := backendAuth(func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	if err := handler(c); err != nil {
+		t.Fatalf("backendAuth returned error: %v", err)
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestBackendAuthRejectsShortRandom(t *testing.T) {
+	backendSecrets = map[string]string{"room1": "shared-secret"}
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+	req.Header.Set("Spreed-Signaling-Random", "tooshort")
+	req.Header.Set("Spreed-Signaling-Checksum", "deadbeef")
+	req.Header.Set("Spreed-Signaling-Backend", "room1")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	handler := backendAuth(func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	if err := handler(c); err != nil {
+		t.Fatalf("backendAuth returned error: %v", err)
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestBackendAuthRejectsReplayedNonce(t *testing.T) {
+	backendSecrets = map[string]string{"room1": "shared-secret"}
+
+	e := echo.New()
+	req := backendTestRequest(t, "room1", "shared-secret", `{"type":"needs"}`)
+	random := req.Header.Get("Spreed-Signaling-Random")
+	checksum := req.Header.Get("Spreed-Signaling-Checksum")
+
+	handler := backendAuth(func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if err := handler(c); err != nil {
+		t.Fatalf("backendAuth returned error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	replay := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"type":"needs"}`))
+	replay.Header.Set("Spreed-Signaling-Random", random)
+	replay.Header.Set("Spreed-Signaling-Checksum", checksum)
+	replay.Header.Set("Spreed-Signaling-Backend", "room1")
+	rec2 := httptest.NewRecorder()
+	c2 := e.NewContext(replay, rec2)
+	if err := handler(c2); err != nil {
+		t.Fatalf("backendAuth returned error: %v", err)
+	}
+	if rec2.Code != http.StatusUnauthorized {
+		t.Errorf("replayed request status = %d, want %d", rec2.Code, http.StatusUnauthorized)
+	}
+}
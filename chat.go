@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"halloween-sims/templates"
+)
+
+const (
+	// chatRateLimit and chatRateWindow bound how often a single session can
+	// post: at most chatRateLimit messages per chatRateWindow.
+	chatRateLimit  = 5
+	chatRateWindow = 10 * time.Second
+
+	// chatHistorySize is how many recent messages a room remembers for
+	// late joiners.
+	chatHistorySize = 50
+
+	// chatMaxMessageLength caps how long a single chat message can be.
+	chatMaxMessageLength = 500
+)
+
+// ChatMessage is a single chat entry, broadcast to sim.<roomID>.chat and
+// kept in a room's ring buffer for late joiners.
+type ChatMessage struct {
+	Author string `json:"author"`
+	Text   string `json:"text"`
+	SentAt int64  `json:"sentAt"`
+}
+
+// postChat validates and rate-limits a chat message from sessionID, appends
+// it to roomID's history ring buffer, and publishes it to sim.<roomID>.chat.
+func (rm *roomManager) postChat(roomID, sessionID, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("message is empty")
+	}
+	if len(text) > chatMaxMessageLength {
+		return fmt.Errorf("message exceeds %d characters", chatMaxMessageLength)
+	}
+
+	r := rm.getOrCreate(roomID)
+
+	r.mu.Lock()
+	if r.chatRate == nil {
+		r.chatRate = make(map[string][]time.Time)
+	}
+	now := time.Now()
+	cutoff := now.Add(-chatRateWindow)
+	recent := r.chatRate[sessionID][:0]
+	for _, t := range r.chatRate[sessionID] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= chatRateLimit {
+		r.chatRate[sessionID] = recent
+		r.mu.Unlock()
+		return fmt.Errorf("rate limit exceeded, slow down")
+	}
+	r.chatRate[sessionID] = append(recent, now)
+
+	msg := ChatMessage{
+		Author: chatAuthorName(sessionID),
+		Text:   text,
+		SentAt: now.Unix(),
+	}
+	r.chatHistory = append(r.chatHistory, msg)
+	if len(r.chatHistory) > chatHistorySize {
+		r.chatHistory = r.chatHistory[len(r.chatHistory)-chatHistorySize:]
+	}
+	r.mu.Unlock()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := rm.nc.Publish("sim."+roomID+".chat", data); err != nil {
+		log.Printf("Failed to publish chat message for room %s: %v", roomID, err)
+	}
+	return nil
+}
+
+// chatHistorySnapshot returns roomID's recent chat messages, oldest first.
+func (rm *roomManager) chatHistorySnapshot(roomID string) []ChatMessage {
+	r := rm.getOrCreate(roomID)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history := make([]ChatMessage, len(r.chatHistory))
+	copy(history, r.chatHistory)
+	return history
+}
+
+// toTemplateChatHistory converts a room's chat history into the shape the
+// templ components render.
+func toTemplateChatHistory(history []ChatMessage) []templates.ChatMessage {
+	out := make([]templates.ChatMessage, len(history))
+	for i, msg := range history {
+		out[i] = toTemplateChatMessage(msg)
+	}
+	return out
+}
+
+// toTemplateChatMessage converts a single chat message into the shape the
+// templ components render.
+func toTemplateChatMessage(msg ChatMessage) templates.ChatMessage {
+	return templates.ChatMessage{Author: msg.Author, Text: msg.Text, SentAt: msg.SentAt}
+}
+
+// chatAuthorName derives a display name from a session ID, since the app
+// has no concept of user accounts.
+func chatAuthorName(sessionID string) string {
+	if len(sessionID) < 6 {
+		return "Guest-" + sessionID
+	}
+	return "Guest-" + sessionID[:6]
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"halloween-sims/templates"
@@ -17,7 +21,6 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
-	"github.com/patrickmn/go-cache"
 	"github.com/starfederation/datastar-go/datastar"
 )
 
@@ -42,9 +45,14 @@ type Needs struct {
 	HygeineRate int `json:"hygeineRate"`
 }
 
-// Global cache for session management
-// Key: session cookie, Value: room UUID
-var sessionCache = cache.New(2*time.Hour, 10*time.Minute)
+// sessionStore holds the active SessionStore backend, selected in main via
+// the SESSION_STORE env var.
+var sessionStore SessionStore
+
+// sessionSecret signs the session cookie so its value can't be forged by a
+// client, and so cookies keep working across a server restart when it's
+// set via the SESSION_SECRET env var.
+var sessionSecret []byte
 
 // generateUUID creates a simple UUID-like string
 func generateUUID() string {
@@ -54,45 +62,74 @@ func generateUUID() string {
 }
 
 // createSession creates a new session with both session cookie and room UUID
-func createSession() (string, string) {
+func createSession() (string, string, error) {
 	sessionID := generateUUID()
 	roomID := generateUUID()
 
-	// Store session cookie -> room UUID mapping in cache
-	sessionCache.Set(sessionID, roomID, cache.DefaultExpiration)
+	if err := sessionStore.Create(sessionID, roomID); err != nil {
+		return "", "", fmt.Errorf("creating session: %w", err)
+	}
 
-	return sessionID, roomID
+	return sessionID, roomID, nil
 }
 
 // getRoomID retrieves the room ID for a given session cookie
 func getRoomID(sessionID string) (string, bool) {
-	if roomID, found := sessionCache.Get(sessionID); found {
-		return roomID.(string), true
+	return sessionStore.Lookup(sessionID)
+}
+
+// touchSession resets sessionID's expiry and refreshes its cookie, keeping
+// an active session alive past its original TTL.
+func touchSession(c echo.Context, sessionID string) {
+	if err := sessionStore.Touch(sessionID); err != nil {
+		log.Printf("Failed to touch session %s: %v", sessionID, err)
+		return
 	}
-	return "", false
+	setSessionCookie(c, sessionID)
 }
 
-// setSessionCookie sets a session cookie in the HTTP response
+// ensureSessionForRoom returns the caller's session ID, creating and
+// cookieing an anonymous one scoped to roomID if they don't already have
+// one. Used by endpoints like chat that any viewer of a room can use, not
+// just the room's owner.
+func ensureSessionForRoom(c echo.Context, roomID string) (string, error) {
+	if sessionID, err := getSessionCookie(c); err == nil {
+		return sessionID, nil
+	}
+	sessionID := generateUUID()
+	if err := sessionStore.Create(sessionID, roomID); err != nil {
+		return "", fmt.Errorf("creating session: %w", err)
+	}
+	setSessionCookie(c, sessionID)
+	return sessionID, nil
+}
+
+// setSessionCookie sets a signed session cookie in the HTTP response
 func setSessionCookie(c echo.Context, sessionID string) {
 	cookie := &http.Cookie{
 		Name:     "session_id",
-		Value:    sessionID,
+		Value:    signSessionID(sessionID, sessionSecret),
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
 		SameSite: http.SameSiteLaxMode,
-		Expires:  time.Now().Add(2 * time.Hour),
+		Expires:  time.Now().Add(sessionTTL),
 	}
 	c.SetCookie(cookie)
 }
 
-// getSessionCookie retrieves the session cookie from the HTTP request
+// getSessionCookie retrieves and verifies the session cookie from the HTTP
+// request, returning the session ID with its signature stripped.
 func getSessionCookie(c echo.Context) (string, error) {
 	cookie, err := c.Cookie("session_id")
 	if err != nil {
 		return "", err
 	}
-	return cookie.Value, nil
+	sessionID, ok := verifySessionID(cookie.Value, sessionSecret)
+	if !ok {
+		return "", fmt.Errorf("session cookie failed signature verification")
+	}
+	return sessionID, nil
 }
 
 // serveHTML serves an HTML file with proper content type
@@ -128,6 +165,9 @@ func serveCSS(c echo.Context, filename string) error {
 }
 
 func main() {
+	rootCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	opts := &server.Options{
 		// DontListen: true, // We want this in process only
 	}
@@ -142,7 +182,6 @@ func main() {
 	if !ns.ReadyForConnections(4 * time.Second) {
 		panic("nats failed")
 	}
-	defer ns.Shutdown()
 
 	nc, err := nats.Connect(ns.ClientURL())
 
@@ -150,6 +189,21 @@ func main() {
 		panic(err)
 	}
 
+	rooms := newRoomManager(nc)
+
+	store, err := newSessionStore()
+	if err != nil {
+		panic(err)
+	}
+	sessionStore = store
+	sessionSecret = loadSessionSecret()
+
+	secrets, err := loadBackendSecrets()
+	if err != nil {
+		panic(err)
+	}
+	backendSecrets = secrets
+
 	e := echo.New()
 
 	// Middleware
@@ -177,7 +231,11 @@ func main() {
 
 	// Root route - create session and redirect to room
 	e.GET("/", func(c echo.Context) error {
-		sessionID, roomID := createSession()
+		sessionID, roomID, err := createSession()
+		if err != nil {
+			log.Printf("Failed to create session: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to create session")
+		}
 		setSessionCookie(c, sessionID)
 		return c.Redirect(http.StatusSeeOther, "/"+roomID)
 	})
@@ -191,15 +249,11 @@ func main() {
 		// In the future, you might want to validate that the room exists
 		// but for read-only access, we don't need session validation
 
-		// Create default sim data
-		simData := templates.SimData{
-			Bladder: 35,
-			Fun:     95,
-			Hunger:  28,
-			Social:  12,
-			Energy:  70,
-			Hygeine: 90,
-		}
+		// Render the room's authoritative needs, not a hardcoded set, so a
+		// reload doesn't flash stale numbers until the first SSE patch.
+		simData := toTemplateSimData(rooms.snapshot(roomID))
+		simData.ViewerCount = rooms.viewerCount(roomID)
+		simData.ChatHistory = toTemplateChatHistory(rooms.chatHistorySnapshot(roomID))
 
 		// Set content type and render using templ template
 		c.Response().Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -221,6 +275,9 @@ func main() {
 		// Create a channel to handle graceful shutdown
 		done := make(chan struct{})
 
+		rooms.subscribe(roomID)
+		defer rooms.unsubscribe(roomID)
+
 		sub, err := nc.Subscribe("sim."+roomID, func(m *nats.Msg) {
 			// Check if the context is still valid before trying to patch signals
 			select {
@@ -252,16 +309,45 @@ func main() {
 			sub.Unsubscribe()
 		}()
 
-		// Send initial signals
-		initialSignals := map[string]any{
-			"bladder": 95,
-			"fun":     95,
-			"hunger":  28,
-			"social":  12,
-			"energy":  70,
-			"hygeine": 90,
+		// Presence and chat are broadcast on their own subjects; forward
+		// them to the browser as datastar signal patches too.
+		presenceSub, err := nc.Subscribe("sim."+roomID+".presence", func(m *nats.Msg) {
+			if err := sse.PatchSignals(m.Data); err != nil {
+				log.Printf("Failed to patch presence for room %s: %v", roomID, err)
+			}
+			if c.Response().Writer != nil {
+				c.Response().Flush()
+			}
+		})
+		if err == nil {
+			defer presenceSub.Unsubscribe()
 		}
-		signalsJSON, _ := json.Marshal(initialSignals)
+
+		chatSub, err := nc.Subscribe("sim."+roomID+".chat", func(m *nats.Msg) {
+			var msg ChatMessage
+			if err := json.Unmarshal(m.Data, &msg); err != nil {
+				log.Printf("Failed to parse chat message for room %s: %v", roomID, err)
+				return
+			}
+			// Append the new message into #chat-history directly, instead of
+			// forwarding it as a signal patch nothing in the template reads -
+			// that left connected viewers unable to see it without a reload.
+			err := sse.PatchElementTempl(templates.ChatMessageItem(toTemplateChatMessage(msg)),
+				datastar.WithSelectorID("chat-history"), datastar.WithModeAppend())
+			if err != nil {
+				log.Printf("Failed to patch chat message for room %s: %v", roomID, err)
+			}
+			if c.Response().Writer != nil {
+				c.Response().Flush()
+			}
+		})
+		if err == nil {
+			defer chatSub.Unsubscribe()
+		}
+
+		// Send the room's current state so late joiners start in sync with
+		// everyone else, instead of a hardcoded set of initial signals.
+		signalsJSON, _ := json.Marshal(rooms.snapshot(roomID))
 		if err := sse.PatchSignals(signalsJSON); err != nil {
 			log.Printf("Failed to send initial signals for room %s: %v", roomID, err)
 			return err
@@ -307,11 +393,21 @@ func main() {
 			log.Printf("Client disconnected from room %s (context cancelled)", roomID)
 		case <-done:
 			log.Printf("Client disconnected from room %s (connection closed)", roomID)
+		case <-rootCtx.Done():
+			log.Printf("Server shutting down, closing connection for room %s", roomID)
 		}
 
 		return nil
 	})
 
+	// Current state snapshot, primarily for late joiners that want the
+	// authoritative needs before their SSE connection delivers the first
+	// patch.
+	e.GET("/:roomID/state", func(c echo.Context) error {
+		roomID := c.Param("roomID")
+		return c.JSON(http.StatusOK, rooms.snapshot(roomID))
+	})
+
 	e.GET("/:roomID/control", func(c echo.Context) error {
 		roomID := c.Param("roomID")
 
@@ -326,22 +422,41 @@ func main() {
 		if !exists || cachedRoomID != roomID {
 			return c.String(http.StatusForbidden, "You don't have access to this sim")
 		}
+		touchSession(c, sessionID)
 
-		// Create default sim data
-		simData := templates.SimData{
-			Bladder: 35,
-			Fun:     95,
-			Hunger:  28,
-			Social:  12,
-			Energy:  70,
-			Hygeine: 90,
-		}
+		// Render the room's authoritative needs, not a hardcoded set, so a
+		// reload doesn't flash stale numbers until the first SSE patch.
+		simData := toTemplateSimData(rooms.snapshot(roomID))
+		simData.ViewerCount = rooms.viewerCount(roomID)
+		simData.ChatHistory = toTemplateChatHistory(rooms.chatHistorySnapshot(roomID))
 
 		// Set content type and render using templ template
 		c.Response().Header().Set("Content-Type", "text/html; charset=utf-8")
 		return templates.ControlPage(roomID, simData).Render(c.Request().Context(), c.Response().Writer)
 	})
 
+	// Chat is open to anyone viewing the room, not just its owner.
+	e.POST("/:roomID/chat", func(c echo.Context) error {
+		roomID := c.Param("roomID")
+		sessionID, err := ensureSessionForRoom(c, roomID)
+		if err != nil {
+			log.Printf("Failed to create session for room %s: %v", roomID, err)
+			return c.String(http.StatusInternalServerError, "Failed to create session")
+		}
+
+		var body struct {
+			Text string `json:"text" form:"text"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid chat payload")
+		}
+
+		if err := rooms.postChat(roomID, sessionID, body.Text); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "ok")
+	})
+
 	e.POST("/:roomID/control", func(c echo.Context) error {
 		roomID := c.Param("roomID")
 
@@ -356,14 +471,22 @@ func main() {
 		if !exists || cachedRoomID != roomID {
 			return c.String(http.StatusForbidden, "You don't have access to this sim")
 		}
+		touchSession(c, sessionID)
 
-		needs := Needs{}
-		datastar.ReadSignals(c.Request(), &needs)
-		data, _ := json.Marshal(needs)
-		nc.Publish("sim."+roomID, data)
+		signals := ControlSignals{}
+		if err := datastar.ReadSignals(c.Request(), &signals); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid signals")
+		}
+		rooms.patch(roomID, signals.toNeedsPatch())
 		return c.String(http.StatusOK, "Control POST request received")
 	})
 
+	// Backend API for external services (hardware, game engines, scripted
+	// scenarios) to drive sim state without a browser session cookie.
+	backendGroup := e.Group("/backend", backendAuth)
+	backendGroup.POST("/room/:roomID/needs", backendNeedsHandler(rooms))
+	backendGroup.POST("/room/:roomID/event", backendEventHandler(nc))
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -373,5 +496,28 @@ func main() {
 	fmt.Printf("Server starting on port %s\n", port)
 	fmt.Printf("Visit http://localhost:%s to start a new session\n", port)
 
-	e.Logger.Fatal(e.Start(":" + port))
+	go func() {
+		if err := e.Start(":" + port); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+
+	<-rootCtx.Done()
+	log.Println("Shutdown signal received, draining connections...")
+
+	rooms.broadcastGoodbye()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+
+	if err := nc.Drain(); err != nil {
+		log.Printf("Error draining NATS connection: %v", err)
+	}
+
+	ns.Shutdown()
+	ns.WaitForShutdown()
+	log.Println("Shutdown complete")
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionTTL is how long a session stays valid, mirroring the session
+// cookie's own expiry.
+const sessionTTL = 2 * time.Hour
+
+// SessionStore maps session cookies to the room they own. It's the seam
+// that lets session ownership live somewhere other than this process, so
+// that /:roomID/control works correctly behind a load balancer.
+type SessionStore interface {
+	// Create associates sessionID with roomID.
+	Create(sessionID, roomID string) error
+	// Lookup returns the roomID for sessionID, if it hasn't expired.
+	Lookup(sessionID string) (string, bool)
+	// Touch resets sessionID's expiry, keeping an active session alive.
+	Touch(sessionID string) error
+	// Delete removes sessionID, e.g. on logout.
+	Delete(sessionID string) error
+}
+
+// newSessionStore builds the SessionStore selected by the SESSION_STORE
+// env var ("memory" or "redis"), defaulting to "memory".
+func newSessionStore() (SessionStore, error) {
+	switch backend := os.Getenv("SESSION_STORE"); backend {
+	case "", "memory":
+		return newMemorySessionStore(), nil
+	case "redis":
+		redisURL := os.Getenv("REDIS_URL")
+		if redisURL == "" {
+			return nil, fmt.Errorf("REDIS_URL must be set when SESSION_STORE=redis")
+		}
+		return newRedisSessionStore(redisURL)
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q (want memory or redis)", backend)
+	}
+}
+
+// memorySessionStore is a process-local SessionStore backed by go-cache.
+// It's the default and matches the original behavior: fine for a single
+// instance, but ownership checks break across multiple pods.
+type memorySessionStore struct {
+	cache *cache.Cache
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{cache: cache.New(sessionTTL, 10*time.Minute)}
+}
+
+func (s *memorySessionStore) Create(sessionID, roomID string) error {
+	s.cache.Set(sessionID, roomID, cache.DefaultExpiration)
+	return nil
+}
+
+func (s *memorySessionStore) Lookup(sessionID string) (string, bool) {
+	roomID, found := s.cache.Get(sessionID)
+	if !found {
+		return "", false
+	}
+	return roomID.(string), true
+}
+
+func (s *memorySessionStore) Touch(sessionID string) error {
+	roomID, found := s.cache.Get(sessionID)
+	if !found {
+		return nil
+	}
+	s.cache.Set(sessionID, roomID, cache.DefaultExpiration)
+	return nil
+}
+
+func (s *memorySessionStore) Delete(sessionID string) error {
+	s.cache.Delete(sessionID)
+	return nil
+}
+
+// redisSessionStore is a SessionStore backed by Redis, so session ownership
+// is shared across every instance behind the load balancer.
+type redisSessionStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisSessionStore(redisURL string) (*redisSessionStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	return &redisSessionStore{client: client, ttl: sessionTTL}, nil
+}
+
+func redisSessionKey(sessionID string) string {
+	return "sims:session:" + sessionID
+}
+
+// loadSessionSecret reads the cookie signing key from SESSION_SECRET. If
+// it's unset, a random key is generated for this process only, matching the
+// old behavior where cookies didn't survive a restart.
+func loadSessionSecret() []byte {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	log.Println("SESSION_SECRET not set, generating an ephemeral signing key; sessions won't survive a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// signSessionID returns sessionID with an HMAC-SHA256 signature appended, so
+// a tampered cookie value can be detected without a server-side lookup.
+func signSessionID(sessionID string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionID))
+	return sessionID + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySessionID checks a signed cookie value produced by signSessionID
+// and returns the underlying session ID.
+func verifySessionID(value string, secret []byte) (string, bool) {
+	sessionID, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionID))
+	expected := mac.Sum(nil)
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(expected, got) {
+		return "", false
+	}
+	return sessionID, true
+}
+
+func (s *redisSessionStore) Create(sessionID, roomID string) error {
+	return s.client.Set(context.Background(), redisSessionKey(sessionID), roomID, s.ttl).Err()
+}
+
+func (s *redisSessionStore) Lookup(sessionID string) (string, bool) {
+	roomID, err := s.client.Get(context.Background(), redisSessionKey(sessionID)).Result()
+	if err != nil {
+		return "", false
+	}
+	return roomID, true
+}
+
+func (s *redisSessionStore) Touch(sessionID string) error {
+	return s.client.Expire(context.Background(), redisSessionKey(sessionID), s.ttl).Err()
+}
+
+func (s *redisSessionStore) Delete(sessionID string) error {
+	return s.client.Del(context.Background(), redisSessionKey(sessionID)).Err()
+}
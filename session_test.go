@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestSignAndVerifySessionID(t *testing.T) {
+	secret := []byte("test-secret")
+
+	signed := signSessionID("abc123", secret)
+
+	sessionID, ok := verifySessionID(signed, secret)
+	if !ok {
+		t.Fatalf("verifySessionID(%q) failed, want success", signed)
+	}
+	if sessionID != "abc123" {
+		t.Errorf("verifySessionID(%q) = %q, want %q", signed, sessionID, "abc123")
+	}
+}
+
+func TestVerifySessionIDRejectsTamperedValue(t *testing.T) {
+	secret := []byte("test-secret")
+	signed := signSessionID("abc123", secret)
+
+	tampered := "abc124" + signed[len("abc123"):]
+
+	if _, ok := verifySessionID(tampered, secret); ok {
+		t.Errorf("verifySessionID(%q) succeeded, want failure for a tampered session ID", tampered)
+	}
+}
+
+func TestVerifySessionIDRejectsWrongSecret(t *testing.T) {
+	signed := signSessionID("abc123", []byte("test-secret"))
+
+	if _, ok := verifySessionID(signed, []byte("other-secret")); ok {
+		t.Error("verifySessionID succeeded with the wrong secret, want failure")
+	}
+}
+
+func TestVerifySessionIDRejectsMalformedValue(t *testing.T) {
+	secret := []byte("test-secret")
+
+	for _, value := range []string{"", "no-dot-here", "abc123.not-hex!!", "abc123."} {
+		if _, ok := verifySessionID(value, secret); ok {
+			t.Errorf("verifySessionID(%q) succeeded, want failure for a malformed value", value)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"halloween-sims/templates"
+)
+
+const (
+	// simTickInterval is how often a room's needs are decremented by their rates.
+	simTickInterval = 1 * time.Second
+	// simIdleTimeout is how long a room's simulation loop keeps running after its
+	// last subscriber leaves before it tears itself down.
+	simIdleTimeout = 5 * time.Minute
+)
+
+// defaultNeeds returns the starting needs for a freshly created room.
+func defaultNeeds() Needs {
+	return Needs{
+		Bladder: 95,
+		Fun:     95,
+		Hunger:  28,
+		Social:  12,
+		Energy:  70,
+		Hygeine: 90,
+	}
+}
+
+// clampNeed keeps a need's value within the 0..100 range the UI expects.
+func clampNeed(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 100 {
+		return 100
+	}
+	return v
+}
+
+// room holds the authoritative state for a single sim and the bookkeeping
+// needed to know when its simulation goroutine should exit.
+type room struct {
+	mu          sync.Mutex
+	needs       Needs
+	subscribers int
+	lastActive  time.Time
+
+	chatHistory []ChatMessage
+	chatRate    map[string][]time.Time
+}
+
+// roomManager owns every active room and is the single place that mutates
+// room state, so the simulation loop and the HTTP handlers never race.
+type roomManager struct {
+	nc *nats.Conn
+
+	mu    sync.Mutex
+	rooms map[string]*room
+}
+
+func newRoomManager(nc *nats.Conn) *roomManager {
+	return &roomManager{
+		nc:    nc,
+		rooms: make(map[string]*room),
+	}
+}
+
+// getOrCreate returns the room for roomID, spawning its simulation goroutine
+// the first time the room is touched.
+func (rm *roomManager) getOrCreate(roomID string) *room {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if r, ok := rm.rooms[roomID]; ok {
+		return r
+	}
+
+	r := &room{
+		needs:      defaultNeeds(),
+		lastActive: time.Now(),
+	}
+	rm.rooms[roomID] = r
+	go rm.simulate(roomID, r)
+	return r
+}
+
+// snapshot returns the current needs for roomID, creating the room (with
+// default needs) if it doesn't exist yet. Used by late joiners instead of a
+// hardcoded set of initial signals.
+func (rm *roomManager) snapshot(roomID string) Needs {
+	r := rm.getOrCreate(roomID)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.needs
+}
+
+// subscribe marks a viewer as present in roomID, preventing the room's
+// simulation goroutine from idling out, and broadcasts the updated viewer
+// count to sim.<roomID>.presence.
+func (rm *roomManager) subscribe(roomID string) {
+	r := rm.getOrCreate(roomID)
+	r.mu.Lock()
+	r.subscribers++
+	r.lastActive = time.Now()
+	r.mu.Unlock()
+	rm.publishPresence(roomID, r)
+}
+
+// unsubscribe removes a viewer from roomID and broadcasts the updated
+// viewer count.
+func (rm *roomManager) unsubscribe(roomID string) {
+	rm.mu.Lock()
+	r, ok := rm.rooms[roomID]
+	rm.mu.Unlock()
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	if r.subscribers > 0 {
+		r.subscribers--
+	}
+	r.lastActive = time.Now()
+	r.mu.Unlock()
+	rm.publishPresence(roomID, r)
+}
+
+// viewerCount returns the number of live viewers in roomID.
+func (rm *roomManager) viewerCount(roomID string) int {
+	r := rm.getOrCreate(roomID)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subscribers
+}
+
+// publishPresence broadcasts roomID's current viewer count to
+// sim.<roomID>.presence.
+func (rm *roomManager) publishPresence(roomID string, r *room) {
+	r.mu.Lock()
+	count := r.subscribers
+	r.mu.Unlock()
+
+	data, _ := json.Marshal(map[string]any{"viewerCount": count})
+	if err := rm.nc.Publish("sim."+roomID+".presence", data); err != nil {
+		log.Printf("Failed to publish presence for room %s: %v", roomID, err)
+	}
+}
+
+// toTemplateSimData converts a room's needs into the shape the templ
+// components render.
+func toTemplateSimData(needs Needs) templates.SimData {
+	return templates.SimData{
+		Bladder: needs.Bladder,
+		Fun:     needs.Fun,
+		Hunger:  needs.Hunger,
+		Social:  needs.Social,
+		Energy:  needs.Energy,
+		Hygeine: needs.Hygeine,
+	}
+}
+
+// NeedsPatch carries a partial update to a room's needs. Nil fields are left
+// untouched; non-nil level fields (Bladder, Fun, ...) are applied as deltas
+// on top of the running state, and non-nil rate fields replace the room's
+// decay rate outright.
+type NeedsPatch struct {
+	Bladder     *int `json:"bladder,omitempty"`
+	BladderRate *int `json:"bladderRate,omitempty"`
+	Fun         *int `json:"fun,omitempty"`
+	FunRate     *int `json:"funRate,omitempty"`
+	Hunger      *int `json:"hunger,omitempty"`
+	HungerRate  *int `json:"hungerRate,omitempty"`
+	Social      *int `json:"social,omitempty"`
+	SocialRate  *int `json:"socialRate,omitempty"`
+	Energy      *int `json:"energy,omitempty"`
+	EnergyRate  *int `json:"energyRate,omitempty"`
+	Hygeine     *int `json:"hygeine,omitempty"`
+	HygeineRate *int `json:"hygeineRate,omitempty"`
+}
+
+// ControlSignals mirrors the Datastar signal store the control form binds
+// its inputs to. It's namespaced under "control" so it never collides with
+// the top-level bladder/fun/... signals the needs panel displays: those are
+// populated by the server's own SSE pushes, and would otherwise get sent
+// right back as a patch on every "Apply" click, deltas and all.
+type ControlSignals struct {
+	Control struct {
+		BladderDelta *int `json:"bladderDelta,omitempty"`
+		BladderRate  *int `json:"bladderRate,omitempty"`
+		FunDelta     *int `json:"funDelta,omitempty"`
+		FunRate      *int `json:"funRate,omitempty"`
+		HungerDelta  *int `json:"hungerDelta,omitempty"`
+		HungerRate   *int `json:"hungerRate,omitempty"`
+		SocialDelta  *int `json:"socialDelta,omitempty"`
+		SocialRate   *int `json:"socialRate,omitempty"`
+		EnergyDelta  *int `json:"energyDelta,omitempty"`
+		EnergyRate   *int `json:"energyRate,omitempty"`
+		HygeineDelta *int `json:"hygeineDelta,omitempty"`
+		HygeineRate  *int `json:"hygeineRate,omitempty"`
+	} `json:"control"`
+}
+
+// toNeedsPatch converts the control form's namespaced signals into the
+// delta/rate patch roomManager.patch expects.
+func (s ControlSignals) toNeedsPatch() NeedsPatch {
+	return NeedsPatch{
+		Bladder:     s.Control.BladderDelta,
+		BladderRate: s.Control.BladderRate,
+		Fun:         s.Control.FunDelta,
+		FunRate:     s.Control.FunRate,
+		Hunger:      s.Control.HungerDelta,
+		HungerRate:  s.Control.HungerRate,
+		Social:      s.Control.SocialDelta,
+		SocialRate:  s.Control.SocialRate,
+		Energy:      s.Control.EnergyDelta,
+		EnergyRate:  s.Control.EnergyRate,
+		Hygeine:     s.Control.HygeineDelta,
+		HygeineRate: s.Control.HygeineRate,
+	}
+}
+
+// patch applies p to roomID's running state and publishes the resulting
+// needs to sim.<roomID>.
+func (rm *roomManager) patch(roomID string, p NeedsPatch) {
+	r := rm.getOrCreate(roomID)
+
+	r.mu.Lock()
+	if p.Bladder != nil {
+		r.needs.Bladder = clampNeed(r.needs.Bladder + *p.Bladder)
+	}
+	if p.BladderRate != nil {
+		r.needs.BladderRate = *p.BladderRate
+	}
+	if p.Fun != nil {
+		r.needs.Fun = clampNeed(r.needs.Fun + *p.Fun)
+	}
+	if p.FunRate != nil {
+		r.needs.FunRate = *p.FunRate
+	}
+	if p.Hunger != nil {
+		r.needs.Hunger = clampNeed(r.needs.Hunger + *p.Hunger)
+	}
+	if p.HungerRate != nil {
+		r.needs.HungerRate = *p.HungerRate
+	}
+	if p.Social != nil {
+		r.needs.Social = clampNeed(r.needs.Social + *p.Social)
+	}
+	if p.SocialRate != nil {
+		r.needs.SocialRate = *p.SocialRate
+	}
+	if p.Energy != nil {
+		r.needs.Energy = clampNeed(r.needs.Energy + *p.Energy)
+	}
+	if p.EnergyRate != nil {
+		r.needs.EnergyRate = *p.EnergyRate
+	}
+	if p.Hygeine != nil {
+		r.needs.Hygeine = clampNeed(r.needs.Hygeine + *p.Hygeine)
+	}
+	if p.HygeineRate != nil {
+		r.needs.HygeineRate = *p.HygeineRate
+	}
+	data, _ := json.Marshal(r.needs)
+	r.mu.Unlock()
+
+	if err := rm.nc.Publish("sim."+roomID, data); err != nil {
+		log.Printf("Failed to publish patched needs for room %s: %v", roomID, err)
+	}
+}
+
+// broadcastGoodbye publishes a goodbye signal to every active room, so
+// connected browsers can show a reconnect banner during a graceful
+// shutdown instead of silently stalling.
+func (rm *roomManager) broadcastGoodbye() {
+	rm.mu.Lock()
+	roomIDs := make([]string, 0, len(rm.rooms))
+	for roomID := range rm.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	rm.mu.Unlock()
+
+	goodbye, _ := json.Marshal(map[string]any{"goodbye": true})
+	for _, roomID := range roomIDs {
+		if err := rm.nc.Publish("sim."+roomID, goodbye); err != nil {
+			log.Printf("Failed to publish goodbye for room %s: %v", roomID, err)
+		}
+	}
+}
+
+// simulate decrements roomID's needs by their rates once per tick and
+// publishes the result, until the room has had no subscribers for
+// simIdleTimeout, at which point it removes the room and exits.
+func (rm *roomManager) simulate(roomID string, r *room) {
+	ticker := time.NewTicker(simTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		if r.subscribers == 0 && time.Since(r.lastActive) > simIdleTimeout {
+			r.mu.Unlock()
+			rm.mu.Lock()
+			delete(rm.rooms, roomID)
+			rm.mu.Unlock()
+			log.Printf("Room %s idle, stopping simulation", roomID)
+			return
+		}
+
+		r.needs.Bladder = clampNeed(r.needs.Bladder - r.needs.BladderRate)
+		r.needs.Fun = clampNeed(r.needs.Fun - r.needs.FunRate)
+		r.needs.Hunger = clampNeed(r.needs.Hunger - r.needs.HungerRate)
+		r.needs.Social = clampNeed(r.needs.Social - r.needs.SocialRate)
+		r.needs.Energy = clampNeed(r.needs.Energy - r.needs.EnergyRate)
+		r.needs.Hygeine = clampNeed(r.needs.Hygeine - r.needs.HygeineRate)
+		data, _ := json.Marshal(r.needs)
+		r.mu.Unlock()
+
+		if err := rm.nc.Publish("sim."+roomID, data); err != nil {
+			log.Printf("Failed to publish simulated needs for room %s: %v", roomID, err)
+		}
+	}
+}